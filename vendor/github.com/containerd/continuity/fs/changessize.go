@@ -0,0 +1,72 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ChangesSize counts the size in bytes of the provided changes, which are
+// resolved against root. Only ChangeKindAdd and ChangeKindModify regular
+// files are counted; directories, whiteouts and other non-regular files
+// do not contribute to the size. Symlinks are followed, so a symlink to a
+// regular file counts that file's size. On Unix, files which share an
+// inode (hardlinks) are only counted once, matching the ChangesSize helper
+// Docker's archive package exposes; on Windows each hardlink is counted.
+func ChangesSize(root string, changes []Change) int64 {
+	seenInodes := make(map[uint64]struct{})
+
+	var size int64
+	for _, c := range changes {
+		size += changeSize(root, c, seenInodes)
+	}
+	return size
+}
+
+// ChangesSizeStream is the streaming equivalent of ChangesSize, for
+// callers driving Changes or DiffDirChanges directly rather than through
+// a materialized slice.
+func ChangesSizeStream(root string, changes <-chan Change) int64 {
+	seenInodes := make(map[uint64]struct{})
+
+	var size int64
+	for c := range changes {
+		size += changeSize(root, c, seenInodes)
+	}
+	return size
+}
+
+func changeSize(root string, c Change, seenInodes map[uint64]struct{}) int64 {
+	if c.Kind != ChangeKindAdd && c.Kind != ChangeKindModify {
+		return 0
+	}
+
+	fi, err := os.Stat(filepath.Join(root, c.Path))
+	if err != nil || fi.IsDir() || !fi.Mode().IsRegular() {
+		return 0
+	}
+
+	if ino, ok := inode(fi); ok {
+		if _, seen := seenInodes[ino]; seen {
+			return 0
+		}
+		seenInodes[ino] = struct{}{}
+	}
+
+	return fi.Size()
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// String returns a short, stable representation of the change in the form
+// "<kind> <path>", e.g. "A /foo", "C /foo" or "D /foo". This matches the
+// ergonomics of the Docker archive package's ChangeType.String.
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s", changeKindLetter(c.Kind), c.Path)
+}
+
+func changeKindLetter(k ChangeKind) string {
+	switch k {
+	case ChangeKindAdd:
+		return "A"
+	case ChangeKindModify:
+		return "C"
+	case ChangeKindDelete:
+		return "D"
+	default:
+		return "U"
+	}
+}
+
+// Sort orders a slice of Change by path, making the result of Collect and
+// CollectDiffDir deterministic regardless of filesystem iteration order.
+func Sort(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+}
+
+// Collect drives Changes for the two given directories and returns the
+// resulting changes as a single slice sorted by path, for callers that
+// want a materialized, deterministically ordered result rather than a
+// callback stream.
+func Collect(ctx context.Context, a, b string) ([]Change, error) {
+	var changes []Change
+	if err := Changes(ctx, a, b, func(kind ChangeKind, path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		changes = append(changes, Change{Kind: kind, Path: path})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	Sort(changes)
+	return changes, nil
+}
+
+// CollectDiffDir drives DiffDirChanges for the given base and diff
+// directories and returns the resulting changes as a single slice sorted
+// by path.
+func CollectDiffDir(ctx context.Context, baseDir, diffDir string, source DiffSource) ([]Change, error) {
+	var changes []Change
+	if err := DiffDirChanges(ctx, baseDir, diffDir, source, func(kind ChangeKind, path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		changes = append(changes, Change{Kind: kind, Path: path})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	Sort(changes)
+	return changes, nil
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceNumbers returns the major/minor device numbers backing fi, for
+// character and block devices.
+func deviceNumbers(fi os.FileInfo) (major, minor uint32, ok bool) {
+	s, isStat := fi.Sys().(*syscall.Stat_t)
+	if !isStat {
+		return 0, 0, false
+	}
+	rdev := uint64(s.Rdev)
+	return unix.Major(rdev), unix.Minor(rdev), true
+}
+
+// sameUnderlyingDir reports whether fa and fb resolve to the same
+// directory on disk, by comparing device and inode number. pathA and
+// pathB are unused on Unix, where os.FileInfo already carries this
+// information, but are part of the cross-platform signature because
+// Windows needs to open a handle to get at it.
+func sameUnderlyingDir(pathA string, fa os.FileInfo, pathB string, fb os.FileInfo) (bool, error) {
+	sa, ok := fa.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, nil
+	}
+	sb, ok := fb.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, nil
+	}
+	return sa.Dev == sb.Dev && sa.Ino == sb.Ino, nil
+}
@@ -0,0 +1,75 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceNumbers is not meaningful on Windows, which has no character
+// device whiteout convention.
+func deviceNumbers(fi os.FileInfo) (major, minor uint32, ok bool) {
+	return 0, 0, false
+}
+
+// sameUnderlyingDir reports whether the directories at pathA and pathB
+// resolve to the same underlying directory, by comparing the volume
+// serial number and file index returned by GetFileInformationByHandle.
+// Unlike Unix, os.FileInfo alone doesn't carry this, so both paths are
+// reopened to query it.
+func sameUnderlyingDir(pathA string, fa os.FileInfo, pathB string, fb os.FileInfo) (bool, error) {
+	ia, err := fileIDFor(pathA)
+	if err != nil {
+		return false, err
+	}
+	ib, err := fileIDFor(pathB)
+	if err != nil {
+		return false, err
+	}
+	return ia == ib, nil
+}
+
+type fileID struct {
+	VolumeSerialNumber uint32
+	FileIndexHigh      uint32
+	FileIndexLow       uint32
+}
+
+func fileIDFor(path string) (fileID, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return fileID{}, err
+	}
+
+	h, err := syscall.CreateFile(p, 0, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return fileID{}, err
+	}
+	defer syscall.CloseHandle(h)
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &info); err != nil {
+		return fileID{}, err
+	}
+
+	return fileID{
+		VolumeSerialNumber: info.VolumeSerialNumber,
+		FileIndexHigh:      info.FileIndexHigh,
+		FileIndexLow:       info.FileIndexLow,
+	}, nil
+}
@@ -18,7 +18,6 @@ package fs
 
 import (
 	"context"
-	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -100,13 +99,46 @@ type ChangeFunc func(ChangeKind, string, os.FileInfo, error) error
 // be considered unchanged if the content is the same. This behavior
 // is to account for timestamp truncation during archiving.
 func Changes(ctx context.Context, a, b string, changeFn ChangeFunc) error {
+	return ChangesWithOptions(ctx, a, b, ChangesOptions{}, changeFn)
+}
+
+// ChangesOptions tunes the double-walk diff performed by ChangesWithOptions.
+type ChangesOptions struct {
+	// AssumeSameInodeUnchanged skips the per-file comparison (and any
+	// resulting changeFn calls) for a directory subtree once both sides
+	// are found to resolve to the same underlying inode (Unix) or file
+	// index (Windows), which is common when snapshotters reuse lower
+	// layers via hard links or bind mounts. A single ChangeKindUnmodified
+	// is reported for the subtree root instead.
+	//
+	// Both trees are still walked and every entry still stat'd by
+	// pathWalk, which runs independently of this comparison and has no
+	// way to learn a subtree can be skipped until doubleWalkDiff has
+	// already received it from both sides; this option only removes the
+	// cost of comparing and reporting each entry already produced by the
+	// walk, not the walk/stat cost itself. For the motivating case of a
+	// large subtree shared via hard links or bind mounts, that walk/stat
+	// cost is normally what dominates, so callers should not expect this
+	// option alone to make diffing such a subtree cheap; skipping the
+	// walk itself would need pathWalk to short-circuit, which it
+	// currently cannot do. It is off by default: callers performing
+	// content-addressable verification still need the full comparison,
+	// since two hardlinked trees are not guaranteed to remain linked
+	// forever.
+	AssumeSameInodeUnchanged bool
+}
+
+// ChangesWithOptions behaves like Changes but allows the double-walk diff
+// to be tuned via opts. The single-walk case (a == "") is unaffected, as
+// it never has a second tree to compare inodes against.
+func ChangesWithOptions(ctx context.Context, a, b string, opts ChangesOptions, changeFn ChangeFunc) error {
 	if a == "" {
 		log.G(ctx).Debugf("Using single walk diff for %s", b)
 		return addDirChanges(ctx, changeFn, b)
 	}
 
 	log.G(ctx).Debugf("Using double walk diff for %s from %s", b, a)
-	return doubleWalkDiff(ctx, changeFn, a, b)
+	return doubleWalkDiff(ctx, changeFn, a, b, opts)
 }
 
 func addDirChanges(ctx context.Context, changeFn ChangeFunc, root string) error {
@@ -139,13 +171,23 @@ const (
 	// DiffSourceOverlayFS indicates that a diff directory is from
 	// OverlayFS.
 	DiffSourceOverlayFS DiffSource = iota
+
+	// DiffSourceAUFS indicates that a diff directory is from AUFS, using
+	// ".wh.<name>" sibling files and ".wh..wh..opq" markers to record
+	// whiteouts.
+	DiffSourceAUFS
+
+	// DiffSourceNative indicates that a diff directory uses a plain
+	// character device with major/minor number 0 to record a whiteout, the same
+	// convention OverlayFS uses, but without requiring the diff
+	// directory to actually be an OverlayFS upperdir.
+	DiffSourceNative
 )
 
 // diffDirOptions is used when the diff can be directly calculated from
 // a diff directory to its base, without walking both trees.
 type diffDirOptions struct {
-	skipChange   func(string, os.FileInfo) (bool, error)
-	deleteChange func(string, string, os.FileInfo, ChangeFunc) (bool, error)
+	deleteChange whiteoutConverter
 }
 
 // DiffDirChanges walks the diff directory and compares changes against the base.
@@ -160,15 +202,12 @@ type diffDirOptions struct {
 //
 // REF: https://github.com/opencontainers/image-spec/blob/v1.0/layer.md#whiteouts
 func DiffDirChanges(ctx context.Context, baseDir, diffDir string, source DiffSource, changeFn ChangeFunc) error {
-	var o *diffDirOptions
-
-	switch source {
-	case DiffSourceOverlayFS:
-		o = &diffDirOptions{
-			deleteChange: overlayFSWhiteoutConvert,
-		}
-	default:
-		return errors.New("unknown diff change source")
+	converter, err := newWhiteoutConverter(source)
+	if err != nil {
+		return err
+	}
+	o := &diffDirOptions{
+		deleteChange: converter,
 	}
 
 	changedDirs := make(map[string]struct{})
@@ -190,28 +229,39 @@ func DiffDirChanges(ctx context.Context, baseDir, diffDir string, source DiffSou
 			return nil
 		}
 
-		if o.skipChange != nil {
-			if skip, err := o.skipChange(path, f); skip {
-				return err
-			}
-		}
-
 		var kind ChangeKind
 
 		deletedFile := false
 
 		if o.deleteChange != nil {
-			deletedFile, err = o.deleteChange(diffDir, path, f, changeFn)
+			result, err := o.deleteChange.convert(diffDir, path, f)
 			if err != nil {
 				return err
 			}
 
-			_, err = os.Stat(filepath.Join(baseDir, path))
-			if err != nil {
-				if !os.IsNotExist(err) {
-					return err
+			if result.deletePath != "" {
+				// The whiteout marker may name a path other than the
+				// one being walked (e.g. AUFS's ".wh.<name>" sibling
+				// records the deletion of "<name>", and its opaque
+				// marker synthesizes a virtual name under the
+				// directory it applies to). Continue as if that path
+				// were the one found, so it gets the same
+				// parent-directory bookkeeping as any other change.
+				path = result.deletePath
+
+				if result.unconditional {
+					deletedFile = true
+				} else if _, err := os.Stat(filepath.Join(baseDir, path)); err != nil {
+					if !os.IsNotExist(err) {
+						return err
+					}
+					// The marker names a path that was never
+					// actually present in baseDir; it is stale or
+					// pre-emptive, so there is nothing to report.
+					return nil
+				} else {
+					deletedFile = true
 				}
-				deletedFile = false
 			}
 		}
 
@@ -270,15 +320,16 @@ func DiffDirChanges(ctx context.Context, baseDir, diffDir string, source DiffSou
 }
 
 // doubleWalkDiff walks both directories to create a diff
-func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b string) (err error) {
+func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b string, opts ChangesOptions) (err error) {
 	g, ctx := errgroup.WithContext(ctx)
 
 	var (
 		c1 = make(chan *currentPath)
 		c2 = make(chan *currentPath)
 
-		f1, f2 *currentPath
-		rmdir  string
+		f1, f2  *currentPath
+		rmdir   string
+		samedir string
 	)
 	g.Go(func() error {
 		defer close(c1)
@@ -313,6 +364,21 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b string) (err
 				continue
 			}
 
+			// Both sides already matched an unmodified directory on a
+			// prior iteration; skip everything underneath it rather
+			// than re-comparing file by file.
+			if samedir != "" {
+				if f1 != nil && strings.HasPrefix(f1.path, samedir) {
+					f1 = nil
+					continue
+				}
+				if f2 != nil && strings.HasPrefix(f2.path, samedir) {
+					f2 = nil
+					continue
+				}
+				samedir = ""
+			}
+
 			var f os.FileInfo
 			k, p := pathChange(f1, f2)
 			switch k {
@@ -335,6 +401,21 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b string) (err
 				}
 				f1 = nil
 			case ChangeKindModify:
+				if opts.AssumeSameInodeUnchanged && f1.f.IsDir() && f2.f.IsDir() {
+					same, err := sameUnderlyingDir(filepath.Join(a, f1.path), f1.f, filepath.Join(b, f2.path), f2.f)
+					if err != nil {
+						return err
+					}
+					if same {
+						f = f2.f
+						samedir = p + string(os.PathSeparator)
+						f1 = nil
+						f2 = nil
+						k = ChangeKindUnmodified
+						break
+					}
+				}
+
 				same, err := sameFile(f1, f2)
 				if err != nil {
 					return err
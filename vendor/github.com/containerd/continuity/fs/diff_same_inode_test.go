@@ -0,0 +1,61 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChangesWithOptionsAssumeSameInodeUnchangedSkipsLinkedSubtree(t *testing.T) {
+	ctx := context.Background()
+
+	a := t.TempDir()
+	sub := filepath.Join(a, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "file"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []Change
+	collect := func(kind ChangeKind, path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		changes = append(changes, Change{Kind: kind, Path: path})
+		return nil
+	}
+
+	// Diffing a tree against itself makes every subdirectory pair resolve
+	// to the same device/inode, the real-world condition the option
+	// targets (reused lower layers via hard links or bind mounts)
+	// without needing root privileges to set one up. "sub" is the first
+	// pair doubleWalkDiff compares after the root, which pathWalk never
+	// emits.
+	if err := ChangesWithOptions(ctx, a, a, ChangesOptions{AssumeSameInodeUnchanged: true}, collect); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Change{{Kind: ChangeKindUnmodified, Path: filepath.Join(string(os.PathSeparator), "sub")}}
+	if len(changes) != len(want) || changes[0] != want[0] {
+		t.Fatalf("got %v, want %v", changes, want)
+	}
+}
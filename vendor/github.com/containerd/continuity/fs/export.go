@@ -0,0 +1,287 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// whiteoutPrefix is the prefix used by OCI/AUFS style whiteout files to
+// indicate a deleted path. See the whiteout discussion in the
+// DiffDirChanges doc comment for the opaque variant of this marker.
+const whiteoutPrefix = ".wh."
+
+// opaqueWhiteout is the name used within a directory to indicate that all
+// siblings present only in the lower layer should be hidden.
+const opaqueWhiteout = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+// opaqueDeleteMarker is the synthetic, single-prefixed name DiffDirChanges
+// reports a ChangeKindDelete under when an AUFS opaque-directory marker is
+// found (see the whiteout discussion in its doc comment). writeWhiteout's
+// ordinary single-prefix whiteout naming turns it into opaqueWhiteout on
+// export, so no special case is needed there.
+const opaqueDeleteMarker = whiteoutPrefix + ".opq"
+
+// exportOptions controls how ExportChanges renders a Change stream to a
+// tar archive.
+type exportOptions struct {
+	format      tar.Format
+	timestamp   *time.Time
+	mapUserID   func(uint32) uint32
+	mapGroupID  func(uint32) uint32
+	xattrFilter func(string) bool
+}
+
+// ExportOpt configures the behavior of ExportChanges.
+type ExportOpt func(*exportOptions) error
+
+// WithUIDGIDMapping remaps the owning uid/gid of each tar entry before it
+// is written, for example to convert a rootless snapshot's user namespace
+// ids back to host ids.
+func WithUIDGIDMapping(mapUID, mapGID func(id uint32) uint32) ExportOpt {
+	return func(o *exportOptions) error {
+		o.mapUserID = mapUID
+		o.mapGroupID = mapGID
+		return nil
+	}
+}
+
+// WithPAXFormat selects PAX tar headers. This is the default, since PAX
+// is the only format able to encode access/change times and xattrs.
+func WithPAXFormat() ExportOpt {
+	return func(o *exportOptions) error {
+		o.format = tar.FormatPAX
+		return nil
+	}
+}
+
+// WithUSTARFormat selects plain USTAR tar headers instead of the default
+// PAX headers. USTAR entries cannot carry access/change times or xattrs;
+// exportFile drops those rather than letting tar.Writer.WriteHeader fail.
+func WithUSTARFormat() ExportOpt {
+	return func(o *exportOptions) error {
+		o.format = tar.FormatUSTAR
+		return nil
+	}
+}
+
+// WithoutTimestamp zeroes the mod, access and change times of every entry,
+// which is useful for producing reproducible layer archives.
+func WithoutTimestamp() ExportOpt {
+	return WithTimestamp(time.Unix(0, 0))
+}
+
+// WithTimestamp normalizes the mod, access and change times of every
+// entry to t.
+func WithTimestamp(t time.Time) ExportOpt {
+	return func(o *exportOptions) error {
+		o.timestamp = &t
+		return nil
+	}
+}
+
+// WithXAttrFilter only includes xattrs for which fn returns true. By
+// default all xattrs returned by the filesystem are included.
+func WithXAttrFilter(fn func(key string) bool) ExportOpt {
+	return func(o *exportOptions) error {
+		o.xattrFilter = fn
+		return nil
+	}
+}
+
+// ExportChanges reads the Change stream produced by Changes or
+// DiffDirChanges and writes it to w as a tar archive rooted at root,
+// suitable for use as an OCI image layer. Deleted paths are translated to
+// OCI whiteout entries rather than being omitted, mirroring the whiteout
+// semantics documented on DiffDirChanges.
+func ExportChanges(ctx context.Context, root string, changes <-chan Change, w io.Writer, opts ...ExportOpt) error {
+	changeFn, closeFn, err := NewExportChangeFunc(root, w, opts...)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c, ok := <-changes:
+			if !ok {
+				return closeFn()
+			}
+			if err := changeFn(c.Kind, c.Path, nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewExportChangeFunc returns a ChangeFunc which appends each change it is
+// called with to a tar archive rooted at root and written to w, along
+// with a close function which must be called once the change stream is
+// exhausted to flush the tar archive's closing records. It is the
+// ChangeFunc-friendly equivalent of ExportChanges, for callers that
+// already drive Changes or DiffDirChanges directly rather than through a
+// channel.
+func NewExportChangeFunc(root string, w io.Writer, opts ...ExportOpt) (ChangeFunc, func() error, error) {
+	o := &exportOptions{
+		// PAX is the default because tar.FileInfoHeader always
+		// populates AccessTime/ChangeTime from the stat info, and
+		// USTAR cannot encode either field; PAX is also required the
+		// moment an entry carries xattrs. WithUSTARFormat can still force
+		// USTAR for callers that know their entries won't hit those
+		// cases.
+		format: tar.FormatPAX,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tw := tar.NewWriter(w)
+
+	changeFn := func(kind ChangeKind, path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if kind == ChangeKindDelete {
+			return writeWhiteout(tw, path)
+		}
+
+		if f == nil {
+			f, err = os.Lstat(filepath.Join(root, path))
+			if err != nil {
+				return err
+			}
+		}
+
+		return exportFile(tw, root, path, f, o)
+	}
+
+	return changeFn, tw.Close, nil
+}
+
+// exportFile writes a single tar entry for path (relative to root)
+// describing f, including file content for regular files.
+func exportFile(tw *tar.Writer, root, path string, f os.FileInfo, o *exportOptions) error {
+	full := filepath.Join(root, path)
+
+	var link string
+	if f.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(full)
+		if err != nil {
+			return fmt.Errorf("failed to read link %s: %w", full, err)
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(f, link)
+	if err != nil {
+		return fmt.Errorf("failed to create tar header for %s: %w", path, err)
+	}
+	hdr.Name = tarName(path)
+	hdr.Format = o.format
+
+	if o.timestamp != nil {
+		hdr.ModTime = *o.timestamp
+		hdr.AccessTime = *o.timestamp
+		hdr.ChangeTime = *o.timestamp
+	}
+
+	if o.mapUserID != nil {
+		hdr.Uid = int(o.mapUserID(uint32(hdr.Uid)))
+	}
+	if o.mapGroupID != nil {
+		hdr.Gid = int(o.mapGroupID(uint32(hdr.Gid)))
+	}
+
+	// USTAR has no fields for these, and tar.Writer.WriteHeader errors
+	// out rather than silently dropping them.
+	if o.format != tar.FormatPAX {
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+	}
+
+	if xattrs, err := readXattrs(full); err == nil && o.format == tar.FormatPAX {
+		for k, v := range xattrs {
+			if o.xattrFilter != nil && !o.xattrFilter(k) {
+				continue
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords["SCHILY.xattr."+k] = v
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", path, err)
+	}
+
+	if f.Mode().IsRegular() {
+		file, err := os.Open(full)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", full, err)
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(tw, file); err != nil {
+			return fmt.Errorf("failed to write tar content for %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// writeWhiteout writes an OCI whiteout entry for path to tw. Deletion of
+// an opaque directory marker (".wh..opq") is rewritten to the opaque
+// whiteout form (".wh..wh..opq") as described in the DiffDirChanges doc
+// comment.
+func writeWhiteout(tw *tar.Writer, path string) error {
+	dir, base := filepath.Split(path)
+
+	// base is always single-prefixed here: DiffDirChanges reports the
+	// opaque-directory case as a delete of opaqueDeleteMarker
+	// (".wh..opq"), which this prefixing turns into the real,
+	// doubly-prefixed opaqueWhiteout (".wh..wh..opq") on its own.
+	name := filepath.Join(dir, whiteoutPrefix+base)
+
+	hdr := &tar.Header{
+		Name: tarName(name),
+		Size: 0,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write whiteout header for %s: %w", path, err)
+	}
+	return nil
+}
+
+// tarName converts path, which uses this package's internal
+// root-relative convention of a leading path separator (e.g. "/foo"), to
+// the root-relative form tar entries require ("foo"): OCI image layer
+// tars must not contain absolute paths.
+func tarName(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(path), "/")
+}
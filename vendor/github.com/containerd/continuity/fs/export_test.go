@@ -0,0 +1,198 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewExportChangeFuncPlainFile(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "foo"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	changeFn, closeFn, err := NewExportChangeFunc(root, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(root, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := changeFn(ChangeKindAdd, "/foo", fi, nil); err != nil {
+		t.Fatalf("export of plain file with default options failed: %v", err)
+	}
+	if err := closeFn(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "foo" {
+		t.Fatalf("expected entry name %q, got %q", "foo", hdr.Name)
+	}
+}
+
+func TestNewExportChangeFuncUSTARDropsUnsupportedFields(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "foo"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	changeFn, closeFn, err := NewExportChangeFunc(root, &buf, WithUSTARFormat())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(root, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := changeFn(ChangeKindAdd, "/foo", fi, nil); err != nil {
+		t.Fatalf("export of plain file under USTAR failed: %v", err)
+	}
+	if err := closeFn(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewExportChangeFuncWhiteout(t *testing.T) {
+	var buf bytes.Buffer
+	changeFn, closeFn, err := NewExportChangeFunc(t.TempDir(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := changeFn(ChangeKindDelete, "/foo", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeFn(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != ".wh.foo" {
+		t.Fatalf("expected whiteout entry %q, got %q", ".wh.foo", hdr.Name)
+	}
+}
+
+// TestExportChangesAUFSOpaqueDir verifies the opaque-directory signal
+// DiffDirChanges synthesizes for an AUFS ".wh..wh..opq" marker survives the
+// full DiffDirChanges -> CollectDiffDir -> ExportChanges round trip as the
+// real OCI opaque whiteout, rather than being silently dropped.
+func TestExportChangesAUFSOpaqueDir(t *testing.T) {
+	ctx := context.Background()
+
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "dir", "old"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	diff := t.TempDir()
+	if err := os.Mkdir(filepath.Join(diff, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(diff, "dir", ".wh..wh..opq"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(diff, "dir", "new"), []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := CollectDiffDir(ctx, base, diff, DiffSourceAUFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportChanges(ctx, diff, changesChan(changes), &buf); err != nil {
+		t.Fatalf("export of AUFS opaque dir diff failed: %v", err)
+	}
+
+	names := map[string]bool{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names[hdr.Name] = true
+	}
+
+	if !names["dir/.wh..wh..opq"] {
+		t.Fatalf("expected an opaque whiteout entry for dir, got %v", names)
+	}
+	if !names["dir/new"] {
+		t.Fatalf("expected the new file under dir to be exported, got %v", names)
+	}
+}
+
+// TestExportChangesAUFSStaleDeleteMarker verifies that an AUFS ".wh.<name>"
+// marker naming a sibling absent from baseDir (a stale or pre-emptive
+// whiteout) does not abort the export: previously it was reported as an
+// Add using the marker's own FileInfo, and ExportChanges re-resolving that
+// path via os.Lstat(root, path) failed since "<name>" never actually
+// existed in diffDir either.
+func TestExportChangesAUFSStaleDeleteMarker(t *testing.T) {
+	ctx := context.Background()
+
+	base := t.TempDir()
+
+	diff := t.TempDir()
+	if err := os.WriteFile(filepath.Join(diff, ".wh.missing"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := CollectDiffDir(ctx, base, diff, DiffSourceAUFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportChanges(ctx, diff, changesChan(changes), &buf); err != nil {
+		t.Fatalf("export of a stale AUFS whiteout marker failed: %v", err)
+	}
+}
+
+// changesChan drains changes into a channel, the form ExportChanges expects.
+func changesChan(changes []Change) <-chan Change {
+	c := make(chan Change, len(changes))
+	for _, change := range changes {
+		c <- change
+	}
+	close(c)
+	return c
+}
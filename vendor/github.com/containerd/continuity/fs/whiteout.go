@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// whiteoutConverter recognizes the on-disk whiteout convention of a single
+// diff source (OverlayFS, AUFS, ...) and translates it into the delete or
+// opaque-directory changes reported by DiffDirChanges. Each snapshotter
+// backend registers its own strategy here rather than DiffDirChanges
+// needing to know about every convention directly. Strategies never call
+// changeFn themselves, so that DiffDirChanges can run every reported
+// change, including ones for a path other than the one it is currently
+// walking, through its usual parent-directory and changedDirs bookkeeping.
+type whiteoutConverter interface {
+	// convert inspects the file at path (relative to diffDir, rooted at
+	// the OS path separator) and reports how DiffDirChanges should
+	// treat it.
+	convert(diffDir, path string, f os.FileInfo) (whiteoutResult, error)
+}
+
+// whiteoutResult is the outcome of inspecting a single diffDir entry for
+// one of the whiteout conventions. The zero value means path is not a
+// whiteout marker and should be processed normally.
+type whiteoutResult struct {
+	// deletePath, if non-empty, is the path that path's whiteout marker
+	// records the deletion of. It is usually path itself (OverlayFS,
+	// DiffSourceNative), but may name a sibling (AUFS's ".wh.<name>"),
+	// or a synthetic, single-prefixed ".wh..opq" name under the
+	// directory an AUFS opaque marker applies to.
+	deletePath string
+
+	// unconditional reports deletePath as deleted without first
+	// confirming it exists in baseDir. Set for the opaque-directory
+	// case, whose deletePath is synthetic and so never exists on
+	// either side of the diff; ordinary per-file whiteout markers
+	// (e.g. AUFS's ".wh.<name>") still need the existence check, since
+	// a marker naming a path absent from baseDir is stale or
+	// pre-emptive and has nothing to report.
+	unconditional bool
+}
+
+// newWhiteoutConverter returns the whiteoutConverter registered for
+// source.
+func newWhiteoutConverter(source DiffSource) (whiteoutConverter, error) {
+	switch source {
+	case DiffSourceOverlayFS:
+		return overlayFSWhiteoutConverter{}, nil
+	case DiffSourceAUFS:
+		return aufsWhiteoutConverter{}, nil
+	case DiffSourceNative:
+		return nativeWhiteoutConverter{}, nil
+	default:
+		return nil, errors.New("unknown diff change source")
+	}
+}
+
+// overlayFSWhiteoutConverter recognizes OverlayFS's convention of a
+// character device with major/minor number 0 in place of a deleted file.
+type overlayFSWhiteoutConverter struct{}
+
+func (overlayFSWhiteoutConverter) convert(diffDir, path string, f os.FileInfo) (whiteoutResult, error) {
+	if !isWhiteoutDevice(f) {
+		return whiteoutResult{}, nil
+	}
+	return whiteoutResult{deletePath: path}, nil
+}
+
+// nativeWhiteoutConverter recognizes the same major/minor 0 character
+// device convention as OverlayFS, but is registered independently so that
+// callers whose diff directory is not actually an OverlayFS upperdir
+// (e.g. a plain rsync'd or hard-linked tree) can still opt in to it.
+type nativeWhiteoutConverter struct{}
+
+func (nativeWhiteoutConverter) convert(diffDir, path string, f os.FileInfo) (whiteoutResult, error) {
+	if !isWhiteoutDevice(f) {
+		return whiteoutResult{}, nil
+	}
+	return whiteoutResult{deletePath: path}, nil
+}
+
+// aufsWhiteoutConverter recognizes AUFS's convention of a ".wh.<name>"
+// sibling regular file to record the deletion of "<name>", and a
+// ".wh..wh..opq" sibling to mark a directory opaque.
+type aufsWhiteoutConverter struct{}
+
+func (aufsWhiteoutConverter) convert(diffDir, path string, f os.FileInfo) (whiteoutResult, error) {
+	dir, base := filepath.Split(path)
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return whiteoutResult{}, nil
+	}
+
+	// The marker file itself is never part of the base directory, so
+	// it is never reported as a change in its own right; it either
+	// records the deletion of a sibling (".wh.<name>") or marks its
+	// parent directory opaque (".wh..wh..opq").
+	//
+	// The opaque case is reported as a synthetic delete of a virtual,
+	// single-prefixed ".wh..opq" name rather than directly as a
+	// ChangeKindModify: OCI forbids any real entry beginning with
+	// ".wh.", so that name can never collide with an actual file, and
+	// routing it through DiffDirChanges's ordinary delete handling
+	// means the directory still gets the same parent-directory
+	// ChangeKindModify as any other change, and ExportChanges (which
+	// prepends a whiteout prefix to every deleted path) naturally
+	// turns it back into the real, doubly-prefixed ".wh..wh..opq"
+	// opaque marker on export, matching the NOTE on DiffDirChanges.
+	if base == opaqueWhiteout {
+		return whiteoutResult{
+			deletePath:    filepath.Join(string(os.PathSeparator), dir, opaqueDeleteMarker),
+			unconditional: true,
+		}, nil
+	}
+
+	name := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	return whiteoutResult{
+		deletePath: filepath.Join(string(os.PathSeparator), name),
+	}, nil
+}
+
+// isWhiteoutDevice reports whether f is a character device with
+// major/minor number 0, the convention OverlayFS (and, by extension,
+// DiffSourceNative) uses to mark a deleted path.
+func isWhiteoutDevice(f os.FileInfo) bool {
+	if f.Mode()&os.ModeCharDevice == 0 || f.Mode()&os.ModeDevice == 0 {
+		return false
+	}
+	major, minor, ok := deviceNumbers(f)
+	return ok && major == 0 && minor == 0
+}
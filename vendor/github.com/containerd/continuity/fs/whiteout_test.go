@@ -0,0 +1,157 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffDirChangesAUFSDeleteReportsParentModify(t *testing.T) {
+	ctx := context.Background()
+
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "dir", "foo"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	diff := t.TempDir()
+	if err := os.Mkdir(filepath.Join(diff, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(diff, "dir", ".wh.foo"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []Change
+	if err := DiffDirChanges(ctx, base, diff, DiffSourceAUFS, func(kind ChangeKind, path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		changes = append(changes, Change{Kind: kind, Path: path})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	Sort(changes)
+
+	want := []Change{
+		{Kind: ChangeKindModify, Path: "/dir"},
+		{Kind: ChangeKindDelete, Path: "/dir/foo"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("got %v, want %v", changes, want)
+		}
+	}
+}
+
+func TestDiffDirChangesAUFSOpaqueDoesNotDuplicateParentModify(t *testing.T) {
+	ctx := context.Background()
+
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "dir", "old"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	diff := t.TempDir()
+	if err := os.Mkdir(filepath.Join(diff, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(diff, "dir", ".wh..wh..opq"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(diff, "dir", "new"), []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []Change
+	if err := DiffDirChanges(ctx, base, diff, DiffSourceAUFS, func(kind ChangeKind, path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		changes = append(changes, Change{Kind: kind, Path: path})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dirModifies := 0
+	for _, c := range changes {
+		if c.Path == "/dir" && c.Kind == ChangeKindModify {
+			dirModifies++
+		}
+	}
+	if dirModifies != 1 {
+		t.Fatalf("expected exactly one modify for /dir, got %d: %v", dirModifies, changes)
+	}
+
+	Sort(changes)
+	want := []Change{
+		{Kind: ChangeKindDelete, Path: "/dir/.wh..opq"},
+		{Kind: ChangeKindModify, Path: "/dir"},
+		{Kind: ChangeKindAdd, Path: "/dir/new"},
+	}
+	Sort(want)
+	if len(changes) != len(want) {
+		t.Fatalf("got %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("got %v, want %v", changes, want)
+		}
+	}
+}
+
+func TestDiffDirChangesAUFSStaleDeleteMarkerReportsNothing(t *testing.T) {
+	ctx := context.Background()
+
+	// base never had "missing", so the marker recording its deletion is
+	// stale or pre-emptive.
+	base := t.TempDir()
+
+	diff := t.TempDir()
+	if err := os.WriteFile(filepath.Join(diff, ".wh.missing"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []Change
+	if err := DiffDirChanges(ctx, base, diff, DiffSourceAUFS, func(kind ChangeKind, path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		changes = append(changes, Change{Kind: kind, Path: path})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 0 {
+		t.Fatalf("expected no changes for a stale whiteout marker, got %v", changes)
+	}
+}